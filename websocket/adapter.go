@@ -0,0 +1,154 @@
+package websocket
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+)
+
+// Adapter wraps a *gorilla/websocket.Conn to satisfy net.Conn, modeled on
+// ShellHub's wsconnadapter. Reads and writes are translated to and from
+// binary websocket frames, with Read buffering any leftover bytes from a
+// frame the caller didn't fully consume.
+//
+// gorilla/websocket allows at most one goroutine to read a *ws.Conn at a
+// time, so an Adapter never reads from conn itself unless it owns that
+// conn exclusively (see NewAdapter). When a Client wraps a connection its
+// readPump goroutine is already the sole reader, so it delivers binary
+// frames to the Adapter with deliverFrame instead.
+type Adapter struct {
+	conn *ws.Conn
+
+	frames  chan []byte
+	readErr error
+
+	readMu   sync.Mutex
+	leftover []byte
+
+	writeMu sync.Mutex
+}
+
+// adapterFrameBufferSize bounds how many binary frames can be queued for an
+// Adapter before whoever is delivering them (Client's readPump, or an
+// Adapter's own feed goroutine) blocks waiting for Read to catch up.
+const adapterFrameBufferSize = 16
+
+// NewAdapter returns a new Adapter that reads conn itself, via its own
+// goroutine. Use this when nothing else reads from conn.
+func NewAdapter(conn *ws.Conn) *Adapter {
+	a := newAdapter(conn)
+	go a.feed()
+	return a
+}
+
+// newAdapter returns a new Adapter wrapping conn without starting a
+// goroutine to read it. The caller is responsible for delivering frames
+// with deliverFrame and deliverReadError.
+func newAdapter(conn *ws.Conn) *Adapter {
+	return &Adapter{
+		conn:   conn,
+		frames: make(chan []byte, adapterFrameBufferSize),
+	}
+}
+
+// feed reads frames from conn and delivers them to the Adapter until conn
+// errors. It's only run for Adapters returned by NewAdapter, which own
+// conn's reads exclusively.
+func (a *Adapter) feed() {
+	for {
+		messageType, data, err := a.conn.ReadMessage()
+		if err != nil {
+			a.deliverReadError(err)
+			return
+		}
+		if messageType != ws.BinaryMessage {
+			continue
+		}
+		a.deliverFrame(data)
+	}
+}
+
+// deliverFrame hands a binary frame's payload to the Adapter for Read to
+// consume.
+func (a *Adapter) deliverFrame(data []byte) {
+	a.frames <- data
+}
+
+// deliverReadError reports that conn's read side is done and no further
+// frames are coming, causing subsequent Reads to return err once any
+// already-delivered frames are drained.
+func (a *Adapter) deliverReadError(err error) {
+	a.readErr = err
+	close(a.frames)
+}
+
+// Read implements net.Conn. Websocket messages are framed, but io.Reader
+// isn't, so a message that the caller doesn't fully consume in one Read is
+// kept around and drained on subsequent calls.
+func (a *Adapter) Read(b []byte) (int, error) {
+	a.readMu.Lock()
+	defer a.readMu.Unlock()
+
+	for len(a.leftover) == 0 {
+		data, ok := <-a.frames
+		if !ok {
+			return 0, a.readErr
+		}
+		// An empty frame (e.g. a keepalive) leaves leftover empty; the loop
+		// condition sends us back around for the next one instead of
+		// returning 0, nil to the caller.
+		a.leftover = data
+	}
+
+	n := copy(b, a.leftover)
+	a.leftover = a.leftover[n:]
+	return n, nil
+}
+
+// Write implements net.Conn by sending b as a single binary websocket
+// message.
+func (a *Adapter) Write(b []byte) (int, error) {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+
+	if err := a.conn.WriteMessage(ws.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close implements net.Conn.
+func (a *Adapter) Close() error {
+	return a.conn.Close()
+}
+
+// LocalAddr implements net.Conn.
+func (a *Adapter) LocalAddr() net.Addr {
+	return a.conn.LocalAddr()
+}
+
+// RemoteAddr implements net.Conn.
+func (a *Adapter) RemoteAddr() net.Addr {
+	return a.conn.RemoteAddr()
+}
+
+// SetDeadline implements net.Conn by forwarding to both the read and write
+// deadlines of the underlying websocket connection.
+func (a *Adapter) SetDeadline(t time.Time) error {
+	if err := a.conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return a.conn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn.
+func (a *Adapter) SetReadDeadline(t time.Time) error {
+	return a.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements net.Conn.
+func (a *Adapter) SetWriteDeadline(t time.Time) error {
+	return a.conn.SetWriteDeadline(t)
+}
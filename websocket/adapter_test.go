@@ -0,0 +1,110 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ws "github.com/gorilla/websocket"
+)
+
+// singleConnListener is a net.Listener that yields exactly one
+// already-established net.Conn to its first Accept call, and then blocks
+// until Close is called. It lets an *http.Server be pointed at a single
+// Adapter as if it were a real listener.
+type singleConnListener struct {
+	conn   net.Conn
+	used   bool
+	closed chan struct{}
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	if !l.used {
+		l.used = true
+		return l.conn, nil
+	}
+	<-l.closed
+	return nil, fmt.Errorf("singleConnListener: closed")
+}
+
+func (l *singleConnListener) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func TestAdapterServesHTTPEndToEnd(t *testing.T) {
+	serverConnCh := make(chan *ws.Conn, 1)
+
+	upgrader := ws.Upgrader{}
+	wsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade error: %v", err)
+			return
+		}
+		serverConnCh <- conn
+	}))
+	defer wsServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(wsServer.URL, "http")
+	clientConn, _, err := ws.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer clientConn.Close() // #nosec G104
+
+	serverConn := <-serverConnCh
+	defer serverConn.Close() // #nosec G104
+
+	clientAdapter := NewAdapter(clientConn)
+	serverAdapter := NewAdapter(serverConn)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "pong")
+	})
+	httpServer := &http.Server{Handler: mux}
+	defer httpServer.Close() // #nosec G104
+
+	listener := newSingleConnListener(serverAdapter)
+	go httpServer.Serve(listener) // #nosec G104
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return clientAdapter, nil
+			},
+		},
+	}
+
+	resp, err := httpClient.Get("http://adapter/ping")
+	if err != nil {
+		t.Fatalf("GET error: %v", err)
+	}
+	defer resp.Body.Close() // #nosec G104
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body error: %v", err)
+	}
+	if string(body) != "pong" {
+		t.Errorf("got body %q, want %q", body, "pong")
+	}
+}
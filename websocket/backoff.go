@@ -0,0 +1,58 @@
+package websocket
+
+import (
+	"math/rand"
+	"time"
+)
+
+// reconnectBackoff computes the delay between successive failed connection
+// attempts using exponential backoff with jitter, similar to the approach
+// used by msgbus and Tendermint's WSClient.
+type reconnectBackoff struct {
+	min    time.Duration
+	max    time.Duration
+	jitter float64
+
+	attempt int
+}
+
+// newReconnectBackoff returns a reconnectBackoff that grows from min to max.
+func newReconnectBackoff(min, max time.Duration, jitter float64) *reconnectBackoff {
+	return &reconnectBackoff{min: min, max: max, jitter: jitter}
+}
+
+// next returns the delay to wait before the next connection attempt and
+// advances the attempt counter. The delay is min(max, min*2^attempt),
+// randomized by +/- jitter.
+func (b *reconnectBackoff) next() time.Duration {
+	shift := b.attempt
+	if shift > 32 {
+		shift = 32
+	}
+	b.attempt++
+
+	delay := b.min * time.Duration(1<<uint(shift))
+	if delay <= 0 || delay > b.max {
+		delay = b.max
+	}
+
+	if b.jitter <= 0 {
+		return delay
+	}
+
+	delta := b.jitter * float64(delay)
+	low := float64(delay) - delta
+	high := float64(delay) + delta
+
+	return time.Duration(low + rand.Float64()*(high-low))
+}
+
+// attempts returns the number of failed attempts recorded so far.
+func (b *reconnectBackoff) attempts() int {
+	return b.attempt
+}
+
+// reset clears the attempt counter, e.g. after a connection starts working.
+func (b *reconnectBackoff) reset() {
+	b.attempt = 0
+}
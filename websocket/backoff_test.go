@@ -0,0 +1,49 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectBackoffGrowsAndCapsAtMax(t *testing.T) {
+	b := newReconnectBackoff(1*time.Second, 10*time.Second, 0)
+
+	want := []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		if got := b.next(); got != w {
+			t.Errorf("next() call %d = %v, want %v", i, got, w)
+		}
+	}
+
+	if attempts := b.attempts(); attempts != len(want) {
+		t.Errorf("attempts() = %d, want %d", attempts, len(want))
+	}
+}
+
+func TestReconnectBackoffResetReturnsToMin(t *testing.T) {
+	b := newReconnectBackoff(1*time.Second, 10*time.Second, 0)
+
+	b.next()
+	b.next()
+	b.reset()
+
+	if attempts := b.attempts(); attempts != 0 {
+		t.Fatalf("attempts() after reset = %d, want 0", attempts)
+	}
+	if got := b.next(); got != 1*time.Second {
+		t.Errorf("next() after reset = %v, want %v", got, 1*time.Second)
+	}
+}
+
+func TestReconnectBackoffJitterStaysWithinBounds(t *testing.T) {
+	b := newReconnectBackoff(10*time.Second, 10*time.Second, 0.2)
+
+	for i := 0; i < 100; i++ {
+		delay := b.next()
+		low := 8 * time.Second
+		high := 12 * time.Second
+		if delay < low || delay > high {
+			t.Fatalf("next() = %v, want within [%v, %v]", delay, low, high)
+		}
+	}
+}
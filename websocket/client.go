@@ -1,7 +1,8 @@
 package websocket
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"time"
 
 	ws "github.com/gorilla/websocket"
+	metrics "github.com/rcrowley/go-metrics"
 	log "github.com/sirupsen/logrus"
 	"github.com/stripe/stripe-cli/useragent"
 )
@@ -24,6 +26,10 @@ import (
 
 // Config contains the optional configuration parameters of a Client.
 type Config struct {
+	// ConnectAttemptWait is no longer used now that failed connection
+	// attempts back off exponentially; it is kept so existing callers that
+	// set it don't fail to compile. See MinReconnectInterval and
+	// MaxReconnectInterval instead.
 	ConnectAttemptWait time.Duration
 
 	Dialer *ws.Dialer
@@ -40,11 +46,52 @@ type Config struct {
 	// Interval at which the websocket client should reset the connection
 	ReconnectInterval time.Duration
 
+	// MinReconnectInterval is the delay after the first failed connection
+	// attempt; after a dropped connection the first reconnect attempt is made
+	// at once. Delays after subsequent failed attempts back off exponentially
+	// up to MaxReconnectInterval.
+	MinReconnectInterval time.Duration
+
+	// MaxReconnectInterval caps the exponential backoff delay between
+	// reconnect attempts.
+	MaxReconnectInterval time.Duration
+
+	// MaxReconnectAttempts is the number of consecutive failed connection
+	// attempts the client will tolerate before giving up and stopping Run.
+	// A value of 0 means retry forever.
+	MaxReconnectAttempts int
+
+	// ReconnectJitter is the fraction (0-1) of each backoff delay that is
+	// randomized, to avoid many clients reconnecting in lockstep.
+	ReconnectJitter float64
+
 	UnixSocket string
 
 	WriteWait time.Duration
 
+	// SendBufferSize is the capacity of the channel SendMessage(Context)
+	// enqueues onto. A full buffer means writePump has fallen behind, not
+	// that the caller should block indefinitely.
+	SendBufferSize int
+
+	// Codec controls how outgoing messages are serialized and incoming
+	// frames are parsed. It defaults to JSON over text frames. Only text
+	// frames are passed to Decode; readPump hands received binary frames to
+	// Client.Conn() instead.
+	Codec Codec
+
+	// Subprotocols is the list of websocket subprotocols offered to the
+	// server during the handshake. Defaults to the stripe-cli devproxy
+	// subprotocol. It is passed to the Dialer that NewClient builds when
+	// Dialer is nil; a caller-supplied Dialer offers its own Subprotocols.
+	Subprotocols []string
+
 	WebhookEventHandler WebhookEventHandler
+
+	// OnReconnect is called after each successful connect(), including the
+	// initial connection, so callers can re-announce filters or endpoint
+	// state to the devproxy after a drop.
+	OnReconnect func(*Client)
 }
 
 // WebhookEventHandler handles a webhook event.
@@ -75,7 +122,11 @@ type Client struct {
 	// Optional configuration parameters
 	cfg *Config
 
-	conn          *ws.Conn
+	conn *ws.Conn
+
+	adapterMu sync.Mutex
+	adapter   *Adapter
+
 	done          chan struct{}
 	isConnected   bool
 	notifyClose   chan error
@@ -83,10 +134,99 @@ type Client struct {
 	stopReadPump  chan struct{}
 	stopWritePump chan struct{}
 	wg            *sync.WaitGroup
+
+	backoff   *reconnectBackoff
+	firstRead *sync.Once
+	stopOnce  sync.Once
+	err       error
+
+	doneCtxOnce sync.Once
+	doneCtx     context.Context
+
+	// ErrorsCh is a buffered channel that read/write pump errors are
+	// non-blockingly published to, in addition to being logged.
+	ErrorsCh chan error
+
+	pingMu          sync.Mutex
+	lastPingSent    time.Time
+	pingPongLatency metrics.Timer
 }
 
-// Run starts listening for incoming webhook requests from Stripe.
+// Conn returns a net.Conn view of the current websocket connection, valid
+// between a successful connect() and the next reconnect. It lets non-JSON
+// payloads (e.g. tunneling local gRPC or HTTP/2 traffic, or stripe logs
+// tail) be multiplexed over the existing authenticated websocket instead of
+// opening a second connection.
+func (c *Client) Conn() net.Conn {
+	c.adapterMu.Lock()
+	adapter := c.adapter
+	c.adapterMu.Unlock()
+
+	if adapter == nil {
+		return nil
+	}
+	return adapter
+}
+
+// Subprotocol returns the subprotocol negotiated with the server during the
+// most recent connect(), so a Codec can switch behavior between protocol
+// versions (e.g. a future stripecli-devproxy-v2). It is empty before the
+// first successful connection.
+func (c *Client) Subprotocol() string {
+	if c.conn == nil {
+		return ""
+	}
+	return c.conn.Subprotocol()
+}
+
+// PingPongLatency returns a metrics.Timer recording the round-trip time
+// between each outbound ping and its matching pong. The timer is reset on
+// every reconnect.
+func (c *Client) PingPongLatency() metrics.Timer {
+	c.pingMu.Lock()
+	defer c.pingMu.Unlock()
+	return c.pingPongLatency
+}
+
+// publishError non-blockingly publishes err to ErrorsCh, dropping it if no
+// one is reading so a slow or absent consumer can never stall the pumps.
+func (c *Client) publishError(err error) {
+	select {
+	case c.ErrorsCh <- err:
+	default:
+	}
+}
+
+// Err returns the terminal error that caused Run to give up after
+// Config.MaxReconnectAttempts was exceeded. It is nil while the client is
+// still running, or if it was stopped via Stop instead of giving up.
+func (c *Client) Err() error {
+	return c.err
+}
+
+// doneContext returns a context.Context cancelled when Stop is called,
+// built once and reused so that repeated calls to Run or SendMessage don't
+// each leak their own watcher goroutine for the life of the process.
+func (c *Client) doneContext() context.Context {
+	c.doneCtxOnce.Do(func() {
+		c.doneCtx = contextFromDoneCh(c.done)
+	})
+	return c.doneCtx
+}
+
+// Run starts listening for incoming webhook requests from Stripe. It is a
+// thin wrapper around RunContext using a context tied to Stop.
 func (c *Client) Run() {
+	_ = c.RunContext(c.doneContext())
+}
+
+// RunContext starts listening for incoming webhook requests from Stripe. It
+// returns when ctx is cancelled or when Config.MaxReconnectAttempts is
+// exhausted, in which case the same error is available afterwards from
+// Err().
+func (c *Client) RunContext(ctx context.Context) error {
+	c.backoff = newReconnectBackoff(c.cfg.MinReconnectInterval, c.cfg.MaxReconnectInterval, c.cfg.ReconnectJitter)
+
 	for {
 		c.isConnected = false
 		c.cfg.Log.WithFields(log.Fields{
@@ -94,17 +234,38 @@ func (c *Client) Run() {
 		}).Debug("Attempting to connect to Stripe")
 
 		for !c.connect() {
+			// next() both computes the delay for the attempt that just
+			// failed and advances the counter, so attempts() here already
+			// reflects this failure -- check it before sleeping, otherwise
+			// the client dials one extra time beyond MaxReconnectAttempts.
+			delay := c.backoff.next()
+			if c.cfg.MaxReconnectAttempts > 0 && c.backoff.attempts() >= c.cfg.MaxReconnectAttempts {
+				c.err = fmt.Errorf("websocket: giving up after %d failed reconnect attempts", c.cfg.MaxReconnectAttempts)
+				c.cfg.Log.WithFields(log.Fields{
+					"prefix": "websocket.client.Run",
+					"error":  c.err,
+				}).Error("Too many failed reconnect attempts, giving up")
+				c.Stop()
+				return c.err
+			}
+
 			c.cfg.Log.WithFields(log.Fields{
 				"prefix": "websocket.client.Run",
+				"delay":  delay,
 			}).Debug("Failed to connect to Stripe. Retrying...")
-			time.Sleep(c.cfg.ConnectAttemptWait)
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
 		}
 		select {
-		case <-c.done:
+		case <-ctx.Done():
 			close(c.send)
 			close(c.stopReadPump)
 			close(c.stopWritePump)
-			return
+			return ctx.Err()
 		case <-c.notifyClose:
 			c.cfg.Log.WithFields(log.Fields{
 				"prefix": "websocket.client.Run",
@@ -126,14 +287,32 @@ func (c *Client) Run() {
 	}
 }
 
-// Stop stops listening for incoming webhook events.
+// Stop stops listening for incoming webhook events. It is safe to call more
+// than once, including from within Run itself after MaxReconnectAttempts is
+// exhausted.
 func (c *Client) Stop() {
-	close(c.done)
+	c.stopOnce.Do(func() {
+		close(c.done)
+	})
 }
 
-// SendMessage sends a message to Stripe through the websocket.
+// SendMessage sends a message to Stripe through the websocket. It is a thin
+// wrapper around SendMessageContext using a context tied to Stop.
 func (c *Client) SendMessage(msg *OutgoingMessage) {
-	c.send <- msg
+	_ = c.SendMessageContext(c.doneContext(), msg)
+}
+
+// SendMessageContext sends a message to Stripe through the websocket,
+// returning ctx's error if it is cancelled before the message can be
+// enqueued. This prevents callers from blocking forever when writePump is
+// wedged between reconnects.
+func (c *Client) SendMessageContext(ctx context.Context, msg *OutgoingMessage) error {
+	select {
+	case c.send <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // connect makes a single attempt to connect to the websocket URL. It returns
@@ -174,15 +353,31 @@ func (c *Client) connect() bool {
 	c.cfg.Log.WithFields(log.Fields{
 		"prefix": "websocket.client.connect",
 	}).Debug("Connected!")
+
+	if c.cfg.OnReconnect != nil {
+		c.cfg.OnReconnect(c)
+	}
+
 	return true
 }
 
 // changeConnection takes a new connection and recreates the channels.
 func (c *Client) changeConnection(conn *ws.Conn) {
 	c.conn = conn
+	// readPump is the connection's sole reader, so the adapter must not read
+	// conn itself; readPump delivers binary frames to it as they arrive.
+	c.adapterMu.Lock()
+	c.adapter = newAdapter(conn)
+	c.adapterMu.Unlock()
 	c.notifyClose = make(chan error)
 	c.stopReadPump = make(chan struct{})
 	c.stopWritePump = make(chan struct{})
+	c.firstRead = &sync.Once{}
+
+	c.pingMu.Lock()
+	c.lastPingSent = time.Time{}
+	c.pingPongLatency = metrics.NewTimer()
+	c.pingMu.Unlock()
 }
 
 // readPump pumps messages from the websocket connection and pushes them into
@@ -202,6 +397,13 @@ func (c *Client) readPump() {
 		c.cfg.Log.WithFields(log.Fields{
 			"prefix": "websocket.Client.readPump",
 		}).Debug("Received pong message")
+
+		c.pingMu.Lock()
+		if !c.lastPingSent.IsZero() {
+			c.pingPongLatency.Update(time.Since(c.lastPingSent))
+		}
+		c.pingMu.Unlock()
+
 		err := c.conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
 		if err != nil {
 			c.cfg.Log.Warn("SetReadDeadline error: ", err)
@@ -210,7 +412,7 @@ func (c *Client) readPump() {
 	})
 
 	for {
-		_, data, err := c.conn.ReadMessage()
+		messageType, data, err := c.conn.ReadMessage()
 		if err != nil {
 			select {
 			case <-c.stopReadPump:
@@ -223,18 +425,38 @@ func (c *Client) readPump() {
 				} else if ws.IsUnexpectedCloseError(err, ws.CloseNormalClosure) {
 					c.cfg.Log.Error("read error: ", err)
 				}
+				c.publishError(err)
 				c.notifyClose <- err
 			}
+			c.adapter.deliverReadError(err)
 			return
 		}
 
+		// A successful read means the connection is actually usable, not
+		// just established, so it's safe to consider the reconnect backoff
+		// resolved.
+		c.firstRead.Do(c.backoff.reset)
+
+		if messageType == ws.BinaryMessage {
+			// Binary frames belong to the multiplexed net.Conn exposed by
+			// Client.Conn(), not the JSON protocol; hand them to the
+			// adapter instead of decoding them here.
+			c.adapter.deliverFrame(data)
+			continue
+		}
+
+		if messageType != ws.TextMessage {
+			continue
+		}
+
 		c.cfg.Log.WithFields(log.Fields{
-			"prefix":  "websocket.Client.readPump",
-			"message": string(data),
+			"prefix":      "websocket.Client.readPump",
+			"messageType": messageType,
+			"message":     string(data),
 		}).Debug("Incoming message")
 
-		var msg IncomingMessage
-		if err = json.Unmarshal(data, &msg); err != nil {
+		msg, err := c.cfg.Codec.Decode(data)
+		if err != nil {
 			c.cfg.Log.Warn("Received malformed message: ", err)
 			continue
 		}
@@ -276,17 +498,30 @@ func (c *Client) writePump() {
 				return
 			}
 
+			messageType, data, err := c.cfg.Codec.Encode(whResp)
+			if err != nil {
+				c.cfg.Log.Warn("Failed to encode outgoing message: ", err)
+				continue
+			}
+
 			c.cfg.Log.WithFields(log.Fields{
-				"prefix": "websocket.Client.writePump",
-			}).Debug("Sending text message")
+				"prefix":      "websocket.Client.writePump",
+				"messageType": messageType,
+			}).Debug("Sending message")
 
-			err = c.conn.WriteJSON(whResp)
+			err = c.conn.WriteMessage(messageType, data)
 			if err != nil {
 				if ws.IsUnexpectedCloseError(err, ws.CloseNormalClosure) {
 					c.cfg.Log.Error("write error: ", err)
 				}
-				// Requeue the message to be processed when writePump restarts
-				c.send <- whResp
+				c.publishError(err)
+				// Drop the message rather than requeueing it onto c.send:
+				// requeueing from here can deadlock writePump against
+				// itself if the channel is already full while the
+				// connection is broken.
+				c.cfg.Log.WithFields(log.Fields{
+					"prefix": "websocket.Client.writePump",
+				}).Warn("Dropping message after write failure")
 				c.notifyClose <- err
 				return
 			}
@@ -298,10 +533,16 @@ func (c *Client) writePump() {
 			c.cfg.Log.WithFields(log.Fields{
 				"prefix": "websocket.Client.writePump",
 			}).Debug("Sending ping message")
+
+			c.pingMu.Lock()
+			c.lastPingSent = time.Now()
+			c.pingMu.Unlock()
+
 			if err = c.conn.WriteMessage(ws.PingMessage, nil); err != nil {
 				if ws.IsUnexpectedCloseError(err, ws.CloseNormalClosure) {
 					c.cfg.Log.Error("write error: ", err)
 				}
+				c.publishError(err)
 				c.notifyClose <- err
 				return
 			}
@@ -326,8 +567,14 @@ func NewClient(url string, webSocketID string, cfg *Config) *Client {
 	if cfg.ConnectAttemptWait == 0 {
 		cfg.ConnectAttemptWait = defaultConnectAttemptWait
 	}
+	if cfg.Subprotocols == nil {
+		cfg.Subprotocols = subprotocols[:]
+	}
 	if cfg.Dialer == nil {
-		cfg.Dialer = newWebSocketDialer(cfg.UnixSocket)
+		cfg.Dialer = newWebSocketDialer(cfg.UnixSocket, cfg.Subprotocols)
+	}
+	if cfg.Codec == nil {
+		cfg.Codec = jsonCodec{}
 	}
 	if cfg.Log == nil {
 		cfg.Log = &log.Logger{Out: ioutil.Discard}
@@ -341,19 +588,33 @@ func NewClient(url string, webSocketID string, cfg *Config) *Client {
 	if cfg.ReconnectInterval == 0 {
 		cfg.ReconnectInterval = defaultReconnectInterval
 	}
+	if cfg.MinReconnectInterval == 0 {
+		cfg.MinReconnectInterval = defaultMinReconnectInterval
+	}
+	if cfg.MaxReconnectInterval == 0 {
+		cfg.MaxReconnectInterval = defaultMaxReconnectInterval
+	}
+	if cfg.ReconnectJitter == 0 {
+		cfg.ReconnectJitter = defaultReconnectJitter
+	}
 	if cfg.WriteWait == 0 {
 		cfg.WriteWait = defaultWriteWait
 	}
+	if cfg.SendBufferSize == 0 {
+		cfg.SendBufferSize = defaultSendBufferSize
+	}
 	if cfg.WebhookEventHandler == nil {
 		cfg.WebhookEventHandler = nullWebhookEventHandler
 	}
 
 	return &Client{
-		URL:         url,
-		WebSocketID: webSocketID,
-		cfg:         cfg,
-		done:        make(chan struct{}),
-		send:        make(chan *OutgoingMessage),
+		URL:             url,
+		WebSocketID:     webSocketID,
+		cfg:             cfg,
+		done:            make(chan struct{}),
+		send:            make(chan *OutgoingMessage, cfg.SendBufferSize),
+		ErrorsCh:        make(chan error, defaultErrorsChBufferSize),
+		pingPongLatency: metrics.NewTimer(),
 	}
 }
 
@@ -368,7 +629,21 @@ const (
 
 	defaultReconnectInterval = 60 * time.Second
 
+	defaultMinReconnectInterval = 1 * time.Second
+
+	defaultMaxReconnectInterval = 30 * time.Second
+
+	// defaultReconnectJitter is applied as a fraction of each backoff delay
+	// so that many clients reconnecting at once don't do so in lockstep.
+	defaultReconnectJitter = 0.2
+
 	defaultWriteWait = 10 * time.Second
+
+	// defaultErrorsChBufferSize is the capacity of Client.ErrorsCh. Errors
+	// are dropped rather than blocking the pumps once it fills up.
+	defaultErrorsChBufferSize = 16
+
+	defaultSendBufferSize = 64
 )
 
 //
@@ -383,7 +658,22 @@ var nullWebhookEventHandler = WebhookEventHandlerFunc(func(*WebhookEvent) {})
 // Private functions
 //
 
-func newWebSocketDialer(unixSocket string) *ws.Dialer {
+// contextFromDoneCh returns a context.Context that is cancelled when done is
+// closed, so the old done-channel-based API can be implemented in terms of
+// the newer context-aware one.
+func contextFromDoneCh(done <-chan struct{}) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx
+}
+
+func newWebSocketDialer(unixSocket string, subprotocols []string) *ws.Dialer {
 	var dialer *ws.Dialer
 	if unixSocket != "" {
 		dialFunc := func(network, addr string) (net.Conn, error) {
@@ -392,14 +682,14 @@ func newWebSocketDialer(unixSocket string) *ws.Dialer {
 		dialer = &ws.Dialer{
 			HandshakeTimeout: 10 * time.Second,
 			NetDial:          dialFunc,
-			Subprotocols:     subprotocols[:],
+			Subprotocols:     subprotocols,
 		}
 	} else {
 		dialer = &ws.Dialer{
 			HandshakeTimeout: 10 * time.Second,
 			Proxy:            http.ProxyFromEnvironment,
-			Subprotocols:     subprotocols[:],
+			Subprotocols:     subprotocols,
 		}
 	}
 	return dialer
-}
\ No newline at end of file
+}
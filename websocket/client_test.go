@@ -0,0 +1,260 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+)
+
+// newEchoWSServer starts an httptest server that upgrades every request to a
+// websocket connection and reads from it until the connection closes, which
+// lets gorilla/websocket's default ping handler reply to pings.
+func newEchoWSServer(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+
+	upgrader := ws.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close() // #nosec G104
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+
+	return server, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestClientMaxReconnectAttemptsExhaustion(t *testing.T) {
+	cfg := &Config{
+		MinReconnectInterval: time.Millisecond,
+		MaxReconnectInterval: 2 * time.Millisecond,
+		MaxReconnectAttempts: 3,
+	}
+	// Port 1 is reserved and nothing listens on it, so every connect()
+	// attempt fails immediately.
+	client := NewClient("ws://127.0.0.1:1", "test-id", cfg)
+
+	err := client.RunContext(context.Background())
+	if err == nil {
+		t.Fatal("RunContext() returned a nil error after exhausting MaxReconnectAttempts")
+	}
+	if client.Err() != err {
+		t.Errorf("client.Err() = %v, want %v", client.Err(), err)
+	}
+}
+
+func TestClientMaxReconnectAttemptsDialCount(t *testing.T) {
+	var mu sync.Mutex
+	dials := 0
+	cfg := &Config{
+		MinReconnectInterval: time.Millisecond,
+		MaxReconnectInterval: 2 * time.Millisecond,
+		MaxReconnectAttempts: 3,
+		Dialer: &ws.Dialer{
+			NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				mu.Lock()
+				dials++
+				mu.Unlock()
+				return nil, errors.New("dial refused by test")
+			},
+		},
+	}
+	client := NewClient("ws://127.0.0.1:1", "test-id", cfg)
+
+	if err := client.RunContext(context.Background()); err == nil {
+		t.Fatal("RunContext() returned a nil error after exhausting MaxReconnectAttempts")
+	}
+
+	mu.Lock()
+	got := dials
+	mu.Unlock()
+	if got != cfg.MaxReconnectAttempts {
+		t.Errorf("dial count = %d, want %d (MaxReconnectAttempts)", got, cfg.MaxReconnectAttempts)
+	}
+}
+
+func TestClientOnReconnectCalledAfterConnect(t *testing.T) {
+	server, url := newEchoWSServer(t)
+	defer server.Close()
+
+	var mu sync.Mutex
+	called := 0
+	cfg := &Config{
+		OnReconnect: func(*Client) {
+			mu.Lock()
+			called++
+			mu.Unlock()
+		},
+	}
+	client := NewClient(url, "test-id", cfg)
+	go client.Run()
+	defer client.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := called
+		mu.Unlock()
+		if n >= 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("OnReconnect was never called after a successful connect")
+}
+
+func TestClientErrorsChReceivesReadErrors(t *testing.T) {
+	upgrader := ws.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close() // #nosec G104 -- close immediately so the client sees a read error
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	client := NewClient(url, "test-id", nil)
+	go client.Run()
+	defer client.Stop()
+
+	select {
+	case err := <-client.ErrorsCh:
+		if err == nil {
+			t.Fatal("received a nil error on ErrorsCh")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for an error on ErrorsCh")
+	}
+}
+
+func TestClientPingPongLatencyRecordsRoundTrip(t *testing.T) {
+	server, url := newEchoWSServer(t)
+	defer server.Close()
+
+	cfg := &Config{
+		PongWait:   200 * time.Millisecond,
+		PingPeriod: 50 * time.Millisecond,
+	}
+	client := NewClient(url, "test-id", cfg)
+	go client.Run()
+	defer client.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if client.PingPongLatency().Count() > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("PingPongLatency never recorded a ping/pong round trip")
+}
+
+// newEchoBinaryWSServer starts an httptest server that upgrades every
+// request to a websocket connection and echoes back any binary frame it
+// reads, so a test can drive Client.Conn() end to end without a second,
+// independent reader racing the Client's own readPump.
+func newEchoBinaryWSServer(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+
+	upgrader := ws.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close() // #nosec G104
+
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if messageType != ws.BinaryMessage {
+				continue
+			}
+			if err := conn.WriteMessage(ws.BinaryMessage, data); err != nil {
+				return
+			}
+		}
+	}))
+
+	return server, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// TestClientConnRoundTripsThroughReadPump drives the Adapter returned by
+// Client.Conn() through a running Client, rather than constructing an
+// Adapter directly on a conn nothing else reads (as adapter_test.go does).
+// It guards against readPump and Adapter.Read racing to read the same
+// *ws.Conn, which -race catches if the hand-off between them regresses.
+func TestClientConnRoundTripsThroughReadPump(t *testing.T) {
+	server, url := newEchoBinaryWSServer(t)
+	defer server.Close()
+
+	client := NewClient(url, "test-id", nil)
+	go client.Run()
+	defer client.Stop()
+
+	var conn net.Conn
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if conn = client.Conn(); conn != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if conn == nil {
+		t.Fatal("Client.Conn() never became non-nil")
+	}
+
+	want := []byte("hello over the multiplexed conn")
+	if _, err := conn.Write(want); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+
+	got := make([]byte, len(want))
+	if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("SetReadDeadline() error: %v", err)
+	}
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("ReadFull() error: %v", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestClientSendMessageContextCancellation(t *testing.T) {
+	// SendBufferSize 1 lets the first call fill the channel; since Run is
+	// never started here, nothing drains it, so the second call is forced
+	// to wait on ctx until it's cancelled.
+	cfg := &Config{SendBufferSize: 1}
+	client := NewClient("ws://127.0.0.1:1", "test-id", cfg)
+
+	if err := client.SendMessageContext(context.Background(), &OutgoingMessage{}); err != nil {
+		t.Fatalf("first SendMessageContext() = %v, want nil", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := client.SendMessageContext(ctx, &OutgoingMessage{}); err != ctx.Err() {
+		t.Errorf("second SendMessageContext() = %v, want %v", err, ctx.Err())
+	}
+}
@@ -0,0 +1,45 @@
+package websocket
+
+import (
+	"encoding/json"
+
+	ws "github.com/gorilla/websocket"
+)
+
+// Codec converts between raw websocket frames and the IncomingMessage and
+// OutgoingMessage types used by the rest of the client. It's pluggable via
+// Config.Codec so the default JSON-over-text behavior can be replaced.
+// Encode may choose text or binary frames for outgoing messages, but
+// readPump only decodes received text frames: received binary frames go to
+// Client.Conn() and never reach Decode.
+type Codec interface {
+	// Decode parses a received text frame's payload into an IncomingMessage.
+	Decode(data []byte) (*IncomingMessage, error)
+
+	// Encode serializes msg into a frame payload, along with the websocket
+	// message type (e.g. ws.TextMessage or ws.BinaryMessage) it should be
+	// sent as.
+	Encode(msg *OutgoingMessage) (messageType int, data []byte, err error)
+}
+
+// jsonCodec is the default Codec, matching the client's historical
+// behavior: JSON-encoded text frames.
+type jsonCodec struct{}
+
+// Decode implements Codec.
+func (jsonCodec) Decode(data []byte) (*IncomingMessage, error) {
+	var msg IncomingMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Encode implements Codec.
+func (jsonCodec) Encode(msg *OutgoingMessage) (int, []byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return 0, nil, err
+	}
+	return ws.TextMessage, data, nil
+}
@@ -0,0 +1,38 @@
+package websocket
+
+import (
+	"testing"
+
+	ws "github.com/gorilla/websocket"
+)
+
+func TestJSONCodecEncodeDecodeRoundTrip(t *testing.T) {
+	codec := jsonCodec{}
+
+	messageType, data, err := codec.Encode(&OutgoingMessage{})
+	if err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	if messageType != ws.TextMessage {
+		t.Errorf("Encode() messageType = %d, want ws.TextMessage", messageType)
+	}
+	if len(data) == 0 {
+		t.Fatal("Encode() returned no data")
+	}
+
+	msg, err := codec.Decode(data)
+	if err != nil {
+		t.Fatalf("Decode() error on Encode()'s own output: %v", err)
+	}
+	if msg == nil {
+		t.Fatal("Decode() returned a nil message")
+	}
+}
+
+func TestJSONCodecDecodeMalformedInput(t *testing.T) {
+	codec := jsonCodec{}
+
+	if _, err := codec.Decode([]byte("not json")); err == nil {
+		t.Error("Decode() on malformed input returned a nil error")
+	}
+}